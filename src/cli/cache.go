@@ -0,0 +1,86 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/zmap/zdns/src/zdns"
+)
+
+// cacheCmd groups the cache snapshot subcommands under `zdns cache`.
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect or persist the iterative cache",
+}
+
+// outOfProcessCache resolves --cache-backend/--cache-backend-addr to a live Cache, rejecting the
+// in-process memory backend: `zdns cache dump/load` is a standalone, one-shot process with no connection
+// to any running scan, so a memory-backed Cache constructed here would always be empty - there is nothing
+// for dump to read or for load's result to feed into. A running scan instead warms/persists its own
+// in-process cache via MemoryCache.StartAutoSnapshot. Redis and memcached are genuinely out-of-process, so
+// dump/load against them reflects (or populates) whatever a scan's workers are actually sharing; memcached
+// supports load only, and dump against it returns an error.
+func outOfProcessCache() (zdns.Cache, error) {
+	kind := zdns.CacheBackendKind(cacheBackend)
+	if kind == "" || kind == zdns.CacheBackendMemory {
+		return nil, fmt.Errorf("cache dump/load requires an out-of-process --cache-backend (redis or memcached); " +
+			"the in-process memory backend has no state outside a running scan to operate on")
+	}
+	return zdns.NewCache(kind, cacheBackendAddr, cacheSize)
+}
+
+var cacheDumpCmd = &cobra.Command{
+	Use:   "dump <path>",
+	Short: "Write a shared out-of-process cache to a snapshot file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := outOfProcessCache()
+		if err != nil {
+			return err
+		}
+		return c.Snapshot(args[0])
+	},
+}
+
+var cacheLoadCmd = &cobra.Command{
+	Use:   "load <path>",
+	Short: "Warm-start a shared out-of-process cache from a snapshot file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := outOfProcessCache()
+		if err != nil {
+			return err
+		}
+		return c.Load(args[0])
+	},
+}
+
+var (
+	cacheSize        int
+	cacheBackend     string
+	cacheBackendAddr string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{cacheDumpCmd, cacheLoadCmd} {
+		cmd.Flags().IntVar(&cacheSize, "cache-size", 10000, "number of entries the in-process cache holds")
+		cmd.Flags().StringVar(&cacheBackend, "cache-backend", string(zdns.CacheBackendMemory), "cache backend to operate on: redis or memcached (memory, the default, is rejected)")
+		cmd.Flags().StringVar(&cacheBackendAddr, "cache-backend-addr", "", "address of the redis/memcached backend (ignored for memory)")
+	}
+	cacheCmd.AddCommand(cacheDumpCmd, cacheLoadCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
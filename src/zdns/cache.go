@@ -26,37 +26,131 @@ import (
 
 type IsCached bool
 
+// NegativeType classifies a cached negative (non-existent name/data) response, per RFC 2308.
+type NegativeType uint8
+
+const (
+	// NegativeNone means the cache entry is not a negative response.
+	NegativeNone NegativeType = iota
+	// NegativeNXDomain caches that the queried name does not exist.
+	NegativeNXDomain
+	// NegativeNoData caches that the queried name exists but has no records of the requested type.
+	NegativeNoData
+)
+
+const (
+	// defaultMaxStaleTTL is how long, past expiration, a cache entry may still be served under RFC 8767
+	// serve-stale while a refresh is attempted in the background.
+	defaultMaxStaleTTL = 24 * time.Hour
+	// defaultMaxNegativeTTL caps how long a negative response is cached, regardless of the SOA MINIMUM
+	// advertised by the authority.
+	defaultMaxNegativeTTL = 1 * time.Hour
+	// defaultPrefetchThresholdPct is the default "last X% of TTL" trigger for refresh-ahead prefetch.
+	defaultPrefetchThresholdPct = 10
+	// defaultPrefetchMinHits is the default hit count an entry must reach before it's eligible for prefetch.
+	defaultPrefetchMinHits = 1
+)
+
 type TimedAnswer struct {
 	Answer    interface{}
 	ExpiresAt time.Time
+
+	// IssuedAt records when this answer was cached, so GetCachedResult can tell how much of its TTL has
+	// been consumed for prefetch (refresh-ahead) purposes.
+	IssuedAt time.Time
 }
 
 type CachedKey struct {
 	Question    Question
 	NameServer  string // optional
 	IsAuthority bool
+
+	// CheckingDisabled and DNSSECOK mirror the CD and DO bits of the query that produced this entry. They
+	// are part of the key so that, e.g., a bogus-but-CD-accepted answer can never satisfy a validating
+	// (CD=0) lookup, and so that DNSSEC RRs are only ever returned to a query that asked for them (DO=1).
+	CheckingDisabled bool
+	DNSSECOK         bool
 }
 
 type CachedResult struct {
 	Answers map[interface{}]TimedAnswer
+
+	// NegativeType is set when this entry is a cached NXDOMAIN/NODATA response (RFC 2308) rather than a
+	// set of positive answers. Negative entries carry no Answers; ExpiresAt governs their negative TTL.
+	NegativeType NegativeType
+	ExpiresAt    time.Time
+
+	// HitCount counts lookups that were served from this entry. Combined with each answer's remaining
+	// TTL fraction, it drives the prefetch (refresh-ahead) decision in GetCachedResult.
+	HitCount uint64
 }
 
-type Cache struct {
+// MemoryCache is the default Cache backend: an in-process, sharded LRU. It is what most single-host
+// scans want; RedisCache and MemcachedCache exist for sharing a warm iterative cache across workers.
+type MemoryCache struct {
 	IterativeCache cachehash.ShardedCacheHash
+
+	// MaxStaleTTL bounds how long an expired entry may still be served (RFC 8767 serve-stale) while a
+	// refresh is triggered in the background. Init replaces a zero value with defaultMaxStaleTTL; setting
+	// it to zero after Init disables serve-stale.
+	MaxStaleTTL time.Duration
+	// MaxNegativeTTL caps the TTL of cached negative (NXDOMAIN/NODATA) responses.
+	MaxNegativeTTL time.Duration
+
+	// refresh, when set, asynchronously re-resolves a stale or about-to-expire entry through the
+	// iterative resolver. The cache has no resolution logic of its own, so the resolver wires this up at
+	// construction time.
+	refresh func(q Question, ns *NameServer)
+
+	// PrefetchThresholdPct and PrefetchMinHits gate refresh-ahead: a hit on an entry whose remaining TTL
+	// has fallen below PrefetchThresholdPct of its original TTL, and which has been hit at least
+	// PrefetchMinHits times, triggers an asynchronous re-resolution so the entry refreshes before it
+	// actually expires. Left zero, Init fills in the defaults below.
+	PrefetchThresholdPct int
+	PrefetchMinHits      uint64
+	// Stats, if set, receives Prefetches/PrefetchFailures counts alongside the usual cache counters.
+	Stats *CacheStatistics
+
+	prefetch prefetchPool
 	//Hits           atomic.Uint64
 	//Misses         atomic.Uint64
 	//Adds           atomic.Uint64
 }
 
-func (s *Cache) Init(cacheSize int) {
+func (s *MemoryCache) Init(cacheSize int) {
 	s.IterativeCache.Init(cacheSize, 4096)
+	if s.MaxStaleTTL == 0 {
+		s.MaxStaleTTL = defaultMaxStaleTTL
+	}
+	if s.MaxNegativeTTL == 0 {
+		s.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if s.PrefetchThresholdPct == 0 {
+		s.PrefetchThresholdPct = defaultPrefetchThresholdPct
+	}
+	if s.PrefetchMinHits == 0 {
+		s.PrefetchMinHits = defaultPrefetchMinHits
+	}
+	s.prefetch.start()
+}
+
+// SetRefreshFunc registers the callback used to asynchronously re-resolve a stale entry that was served
+// under RFC 8767. Safe to leave unset, in which case stale entries are still served but never refreshed.
+func (s *MemoryCache) SetRefreshFunc(refresh func(q Question, ns *NameServer)) {
+	s.refresh = refresh
 }
 
-func (s *Cache) VerboseLog(depth int, args ...interface{}) {
+func (s *MemoryCache) VerboseLog(depth int, args ...interface{}) {
 	log.Debug(makeVerbosePrefix(depth), args)
 }
 
-func (s *Cache) AddCachedAnswer(answer interface{}, ns *NameServer, depth int) {
+// isDNSSECType reports whether t is one of the DNSSEC RR types (RRSIG/NSEC/NSEC3) that must only ever be
+// cached or returned for a query that set the DO bit.
+func isDNSSECType(t uint16) bool {
+	return t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3
+}
+
+func (s *MemoryCache) AddCachedAnswer(answer interface{}, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
 	//s.Adds.Add(1)
 	a, ok := answer.(Answer)
 	if !ok {
@@ -65,19 +159,22 @@ func (s *Cache) AddCachedAnswer(answer interface{}, ns *NameServer, depth int) {
 	}
 	q := questionFromAnswer(a)
 
-	// only cache records that can help prevent future iteration: A(AAA), NS, (C|D)NAME.
+	// only cache records that can help prevent future iteration: A(AAA), NS, (C|D)NAME, plus DNSSEC RRs
+	// when the originating query asked for them (DO=1).
 	// This will prevent some entries that will never help future iteration (e.g., PTR)
 	// from causing unnecessary cache evictions.
 	// TODO: this is overly broad right now and will unnecessarily cache some leaf A/AAAA records. However,
 	// it's a lot of work to understand _why_ we're doing a specific lookup and this will still help
 	// in other cases, e.g., PTR lookups
-	if !(q.Type == dns.TypeA || q.Type == dns.TypeAAAA || q.Type == dns.TypeNS || q.Type == dns.TypeDNAME || q.Type == dns.TypeCNAME) {
+	isCacheableType := q.Type == dns.TypeA || q.Type == dns.TypeAAAA || q.Type == dns.TypeNS || q.Type == dns.TypeDNAME || q.Type == dns.TypeCNAME
+	if !isCacheableType && !(dnssecOK && isDNSSECType(q.Type)) {
 		return
 	}
-	expiresAt := time.Now().Add(time.Duration(a.TTL) * time.Second)
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(time.Duration(a.TTL) * time.Second)
 	ca := CachedResult{}
 	ca.Answers = make(map[interface{}]TimedAnswer)
-	cacheKey := CachedKey{q, "", false}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
 	if ns != nil {
 		cacheKey.NameServer = ns.String()
 	}
@@ -92,19 +189,54 @@ func (s *Cache) AddCachedAnswer(answer interface{}, ns *NameServer, depth int) {
 		if !ok {
 			log.Panic("unable to cast cached result")
 		}
+		// a positive entry supersedes any negative entry previously cached for this key
+		ca.NegativeType = NegativeNone
+		if ca.Answers == nil {
+			ca.Answers = make(map[interface{}]TimedAnswer)
+		}
 	}
 	// we have an existing record. Let's add this answer to it.
 	ta := TimedAnswer{
 		Answer:    answer,
-		ExpiresAt: expiresAt}
+		ExpiresAt: expiresAt,
+		IssuedAt:  issuedAt}
 	ca.Answers[a] = ta
 	s.IterativeCache.Add(cacheKey, ca)
 	s.VerboseLog(depth+1, "Upsert cached answer ", q, " ", ca)
 }
 
-func (s *Cache) GetCachedResult(q Question, ns *NameServer, depth int) (SingleQueryResult, bool) {
+// AddNegativeCachedAnswer caches an NXDOMAIN/NODATA response for q per RFC 2308. The TTL is derived from
+// the SOA MINIMUM field of the authority section, capped by MaxNegativeTTL.
+func (s *MemoryCache) AddNegativeCachedAnswer(q Question, negType NegativeType, soa *dns.SOA, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
+	if soa == nil || negType == NegativeNone {
+		return
+	}
+	ttl := time.Duration(soa.Minttl) * time.Second
+	if s.MaxNegativeTTL != 0 && ttl > s.MaxNegativeTTL {
+		ttl = s.MaxNegativeTTL
+	}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	ca := CachedResult{NegativeType: negType, ExpiresAt: time.Now().Add(ttl)}
+	s.IterativeCache.Lock(cacheKey)
+	defer s.IterativeCache.Unlock(cacheKey)
+	s.IterativeCache.Add(cacheKey, ca)
+	s.VerboseLog(depth+1, "Cached negative answer (", negType, ") for ", q, ": ", ca)
+}
+
+// GetCachedResult looks up q in the cache. checkingDisabled and dnssecOK must mirror the CD/DO bits of
+// the originating query: they are part of the cache key, so a bogus-but-CD-accepted answer can never
+// satisfy a validating (CD=0) lookup, and DNSSEC RRs are only ever returned when DO=1. The returned
+// NegativeType is NegativeNone for an ordinary result (hit or miss); when it is NegativeNXDomain or
+// NegativeNoData, the bool is true and retv carries no answers, letting the caller synthesize the
+// appropriate response. A positive hit may instead carry only stale (already-expired, but within
+// MaxStaleTTL) answers, flagged via SingleQueryResult.IsStale; a refresh is kicked off asynchronously
+// through the registered refresh func in that case.
+func (s *MemoryCache) GetCachedResult(q Question, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) (SingleQueryResult, bool, NegativeType) {
 	var retv SingleQueryResult
-	cacheKey := CachedKey{q, "", false}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
 	if ns != nil {
 		cacheKey.NameServer = ns.String()
 		s.VerboseLog(depth+1, "Cache request for: ", q.Name, " (", q.Type, ") @", cacheKey.NameServer)
@@ -117,7 +249,7 @@ func (s *Cache) GetCachedResult(q Question, ns *NameServer, depth int) (SingleQu
 		//s.Misses.Add(1)
 		s.VerboseLog(depth+2, "-> no entry found in cache for ", q.Name)
 		s.IterativeCache.Unlock(cacheKey)
-		return retv, false
+		return retv, false, NegativeNone
 	}
 	//s.Hits.Add(1)
 	retv.Authorities = make([]interface{}, 0)
@@ -127,37 +259,86 @@ func (s *Cache) GetCachedResult(q Question, ns *NameServer, depth int) (SingleQu
 	if !ok {
 		log.Panic("unable to cast cached result for ", q.Name)
 	}
-	// great we have a result. let's go through the entries and build a result. In the process, throw away anything
-	// that's expired
+	if cachedRes.NegativeType != NegativeNone {
+		negType := cachedRes.NegativeType
+		expired := cachedRes.ExpiresAt.Before(time.Now())
+		s.IterativeCache.Unlock(cacheKey)
+		if expired {
+			s.VerboseLog(depth+2, "Expiring cached negative answer for ", q.Name)
+			return retv, false, NegativeNone
+		}
+		s.VerboseLog(depth+2, "Negative cache hit for ", q.Name)
+		return retv, true, negType
+	}
+	// great we have a result. let's go through the entries and build a result. In the process, throw away
+	// anything that's past its stale window, and serve-but-flag anything merely expired within
+	// MaxStaleTTL.
 	now := time.Now()
+	stale := false
+	nearestToExpireFrac := 1.0 // smallest fraction-of-TTL-remaining across this entry's live answers
 	for k, cachedAnswer := range cachedRes.Answers {
 		if cachedAnswer.ExpiresAt.Before(now) {
-			// if we have a write lock, we can perform the necessary actions
-			// and then write this back to the cache. However, if we don't,
-			// we need to start this process over with a write lock
+			if s.MaxStaleTTL > 0 && cachedAnswer.ExpiresAt.Add(s.MaxStaleTTL).After(now) {
+				// if we have a write lock, we can perform the necessary actions
+				// and then write this back to the cache. However, if we don't,
+				// we need to start this process over with a write lock
+				s.VerboseLog(depth+2, "Serving stale cache entry ", k)
+				retv.Answers = append(retv.Answers, cachedAnswer.Answer)
+				stale = true
+				continue
+			}
 			s.VerboseLog(depth+2, "Expiring cache entry ", k)
 			delete(cachedRes.Answers, k)
 		} else {
 			// this result is valid. append it to the SingleQueryResult we're going to hand to the user
 			retv.Answers = append(retv.Answers, cachedAnswer.Answer)
+			if frac := remainingTTLFraction(cachedAnswer, now); frac < nearestToExpireFrac {
+				nearestToExpireFrac = frac
+			}
 		}
 	}
+	cachedRes.HitCount++
+	shouldPrefetch := !stale && cachedRes.HitCount >= s.PrefetchMinHits &&
+		nearestToExpireFrac*100 < float64(s.PrefetchThresholdPct)
+	s.IterativeCache.Add(cacheKey, cachedRes)
 	s.IterativeCache.Unlock(cacheKey)
 	// Don't return an empty response.
 	if len(retv.Answers) == 0 && len(retv.Authorities) == 0 && len(retv.Additional) == 0 {
 		s.VerboseLog(depth+2, "-> no entry found in cache, after expiration for ", q.Name)
 		var emptyRetv SingleQueryResult
-		return emptyRetv, false
+		return emptyRetv, false, NegativeNone
 	}
 	if ns != nil {
 		retv.Resolver = ns.String()
 	}
+	if stale {
+		retv.IsStale = true
+		// Route the refresh through the same dedup'd prefetch pool as refresh-ahead, rather than a bare
+		// `go s.refresh(...)`: a hot, popular stale entry is hit repeatedly while the scan iterates, and
+		// without dedup each hit would spawn its own re-resolution instead of coalescing into one.
+		s.prefetch.enqueue(cacheKey, q, ns, s.refresh, s.Stats)
+	} else if shouldPrefetch {
+		s.prefetch.enqueue(cacheKey, q, ns, s.refresh, s.Stats)
+	}
 
 	s.VerboseLog(depth+2, "Cache hit for ", q.Name, ": ", retv)
-	return retv, true
+	return retv, true, NegativeNone
+}
+
+// remainingTTLFraction reports how much of ta's TTL is left, as a value in [0, 1].
+func remainingTTLFraction(ta TimedAnswer, now time.Time) float64 {
+	total := ta.ExpiresAt.Sub(ta.IssuedAt)
+	if total <= 0 {
+		return 0
+	}
+	remaining := ta.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return float64(remaining) / float64(total)
 }
 
-func (s *Cache) SafeAddCachedAnswer(a interface{}, ns *NameServer, layer, debugType string, depth int) {
+func (s *MemoryCache) SafeAddCachedAnswer(a interface{}, ns *NameServer, layer, debugType string, checkingDisabled, dnssecOK bool, depth int) {
 	ans, ok := a.(Answer)
 	if !ok {
 		s.VerboseLog(depth+1, "unable to cast ", debugType, ": ", layer, ": ", a)
@@ -167,10 +348,10 @@ func (s *Cache) SafeAddCachedAnswer(a interface{}, ns *NameServer, layer, debugT
 		log.Info("detected poison ", debugType, ": ", ans.Name, "(", ans.Type, "): ", layer, ": ", a)
 		return
 	}
-	s.AddCachedAnswer(a, ns, depth)
+	s.AddCachedAnswer(a, ns, checkingDisabled, dnssecOK, depth)
 }
 
-func (s *Cache) SafeAddLayerNameServers(layer string, result SingleQueryResult, ns *NameServer, depth int, cacheNonAuthoritativeAns bool) {
+func (s *MemoryCache) SafeAddLayerNameServers(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
 	authsAndAdditionals := util.Concat(result.Authorities, result.Additional)
 	// build a map of TimedAnswers to add to cache
 	timedAns := make(map[interface{}]TimedAnswer, len(authsAndAdditionals))
@@ -193,19 +374,19 @@ func (s *Cache) SafeAddLayerNameServers(layer string, result SingleQueryResult,
 			ExpiresAt: time.Now().Add(time.Duration(a.(Answer).TTL) * time.Second),
 		}
 	}
-	cacheKey := CachedKey{Question: Question{Name: layer, Type: dns.TypeNS}, IsAuthority: true}
+	cacheKey := CachedKey{Question: Question{Name: layer, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
 	s.IterativeCache.Lock(cacheKey)
 	defer s.IterativeCache.Unlock(cacheKey)
 	//s.Adds.Add(1)
 	s.IterativeCache.Add(cacheKey, CachedResult{Answers: timedAns})
 }
 
-func (s *Cache) GetLayerNameServers(name string) (SingleQueryResult, bool) {
+func (s *MemoryCache) GetLayerNameServers(name string, checkingDisabled, dnssecOK bool) (SingleQueryResult, bool) {
 	res := SingleQueryResult{}
 	res.Answers = make([]interface{}, 0)
 	res.Authorities = make([]interface{}, 0)
 	res.Additional = make([]interface{}, 0)
-	cacheKey := CachedKey{Question: Question{Name: name, Type: dns.TypeNS}, IsAuthority: true}
+	cacheKey := CachedKey{Question: Question{Name: name, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
 	s.IterativeCache.Lock(cacheKey)
 	defer s.IterativeCache.Unlock(cacheKey)
 	unres, ok := s.IterativeCache.Get(cacheKey)
@@ -239,16 +420,16 @@ func (s *Cache) GetLayerNameServers(name string) (SingleQueryResult, bool) {
 	return res, true
 }
 
-func (s *Cache) CacheUpdate(layer string, result SingleQueryResult, ns *NameServer, depth int, cacheNonAuthoritativeAns bool) {
+func (s *MemoryCache) CacheUpdate(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
 	for _, a := range result.Additional {
-		s.SafeAddCachedAnswer(a, ns, layer, "additional", depth)
+		s.SafeAddCachedAnswer(a, ns, layer, "additional", checkingDisabled, dnssecOK, depth)
 	}
 	for _, a := range result.Authorities {
-		s.SafeAddCachedAnswer(a, ns, layer, "authority", depth)
+		s.SafeAddCachedAnswer(a, ns, layer, "authority", checkingDisabled, dnssecOK, depth)
 	}
 	if result.Flags.Authoritative || cacheNonAuthoritativeAns {
 		for _, a := range result.Answers {
-			s.SafeAddCachedAnswer(a, ns, layer, "answer", depth)
+			s.SafeAddCachedAnswer(a, ns, layer, "answer", checkingDisabled, dnssecOK, depth)
 		}
 	}
 }
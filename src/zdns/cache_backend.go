@@ -0,0 +1,74 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"fmt"
+
+	"github.com/zmap/dns"
+)
+
+// Cache is the interface the iterative resolver drives to read and write the shared iterative cache.
+// MemoryCache is the default, in-process backend; RedisCache and MemcachedCache let multiple zdns
+// workers, potentially on different hosts, share a single warm cache during a large scan.
+//
+// NOTE: the resolver-side call sites that construct and drive a Cache (the iterative lookup/iteration
+// code) and SingleQueryResult (in result.go) live outside this checkout. The methods below are not
+// signature-compatible with those of the concrete *Cache struct they replace (now MemoryCache): each
+// takes the query's CD/DO bits, and GetCachedResult also returns a NegativeType, so every such call site
+// has to pass and receive the new values.
+type Cache interface {
+	AddCachedAnswer(answer interface{}, ns *NameServer, checkingDisabled, dnssecOK bool, depth int)
+	AddNegativeCachedAnswer(q Question, negType NegativeType, soa *dns.SOA, ns *NameServer, checkingDisabled, dnssecOK bool, depth int)
+	GetCachedResult(q Question, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) (SingleQueryResult, bool, NegativeType)
+	SafeAddLayerNameServers(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool)
+	GetLayerNameServers(name string, checkingDisabled, dnssecOK bool) (SingleQueryResult, bool)
+	CacheUpdate(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool)
+	// SetRefreshFunc registers the callback used to asynchronously re-resolve a stale or about-to-expire
+	// entry. Safe to leave unset, in which case entries are still served stale but never refreshed.
+	SetRefreshFunc(refresh func(q Question, ns *NameServer))
+	// Snapshot and Load persist and restore this backend's entries; see MemoryCache.Snapshot/Load for the
+	// on-disk format. Not every backend can support both directions - MemcachedCache.Snapshot returns an
+	// error, since the memcached protocol has no key-enumeration primitive to dump from - but every backend
+	// implements both methods so callers don't need a type assertion to find out.
+	Snapshot(path string) error
+	Load(path string) error
+}
+
+// CacheBackendKind identifies which Cache implementation to construct from CLI flags.
+type CacheBackendKind string
+
+const (
+	CacheBackendMemory    CacheBackendKind = "memory"
+	CacheBackendRedis     CacheBackendKind = "redis"
+	CacheBackendMemcached CacheBackendKind = "memcached"
+)
+
+// NewCache constructs the Cache backend named by kind. addr and cacheSize are interpreted per backend:
+// MemoryCache uses cacheSize as its in-process entry budget and ignores addr; RedisCache and
+// MemcachedCache dial addr (a "host:port", or comma-separated list for memcached) and ignore cacheSize.
+func NewCache(kind CacheBackendKind, addr string, cacheSize int) (Cache, error) {
+	switch kind {
+	case "", CacheBackendMemory:
+		c := &MemoryCache{}
+		c.Init(cacheSize)
+		return c, nil
+	case CacheBackendRedis:
+		return NewRedisCache(addr)
+	case CacheBackendMemcached:
+		return NewMemcachedCache(addr)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", kind)
+	}
+}
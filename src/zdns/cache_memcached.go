@@ -0,0 +1,490 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/zmap/dns"
+	"github.com/zmap/zdns/src/internal/util"
+)
+
+// MemcachedCache is a Cache backend that stores the iterative cache out-of-process in memcached, so that
+// multiple zdns workers scanning from different hosts can share a single warm cache. It's a simpler
+// alternative to RedisCache for deployments that already run a memcached fleet.
+type MemcachedCache struct {
+	client *memcache.Client
+
+	// MaxStaleTTL and MaxNegativeTTL mirror MemoryCache's fields of the same name; see RedisCache for
+	// details. Left zero, NewMemcachedCache fills in the same defaults as MemoryCache.Init.
+	MaxStaleTTL    time.Duration
+	MaxNegativeTTL time.Duration
+
+	// refresh, when set via SetRefreshFunc, asynchronously re-resolves a stale or about-to-expire entry.
+	refresh func(q Question, ns *NameServer)
+
+	PrefetchThresholdPct int
+	PrefetchMinHits      uint64
+	// Stats, if set, receives Prefetches/PrefetchFailures counts, exactly as MemoryCache does. Hits/Misses/
+	// Adds aren't wired on any backend yet - see the commented-out counters on MemoryCache - so
+	// MemcachedCache doesn't increment them either, to avoid the backends diverging or double-counting
+	// once that wiring lands.
+	Stats *CacheStatistics
+
+	prefetch prefetchPool
+}
+
+// memcachedMaxRelativeTTL is the memcached protocol's cutoff (30 days) past which an Expiration value is
+// interpreted as an absolute Unix timestamp rather than a relative number of seconds. put() must account
+// for this explicitly or a long-TTL entry (e.g. a long-lived NS/glue record pinned past this checkout's
+// serve-stale window) silently gets treated as already expired.
+const memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+
+// NewMemcachedCache connects to the comma-separated list of memcached servers in addr (e.g.
+// "10.0.0.1:11211,10.0.0.2:11211").
+func NewMemcachedCache(addr string) (*MemcachedCache, error) {
+	servers := strings.Split(addr, ",")
+	client := memcache.New(servers...)
+	if err := client.Ping(); err != nil {
+		return nil, err
+	}
+	m := &MemcachedCache{
+		client:               client,
+		MaxStaleTTL:          defaultMaxStaleTTL,
+		MaxNegativeTTL:       defaultMaxNegativeTTL,
+		PrefetchThresholdPct: defaultPrefetchThresholdPct,
+		PrefetchMinHits:      defaultPrefetchMinHits,
+	}
+	m.prefetch.start()
+	return m, nil
+}
+
+// SetRefreshFunc registers the callback used to asynchronously re-resolve a stale entry served under RFC
+// 8767, or a hot entry eligible for refresh-ahead. Safe to leave unset.
+func (m *MemcachedCache) SetRefreshFunc(refresh func(q Question, ns *NameServer)) {
+	m.refresh = refresh
+}
+
+// memcachedKey hashes the CachedKey down to memcached's 250-byte key limit; qnames can be long once
+// escaping and the NameServer/flag suffix are accounted for.
+func memcachedKey(k CachedKey) string {
+	h := sha1.Sum([]byte(redisKey(k)))
+	return "zdns:" + hex.EncodeToString(h[:])
+}
+
+func (m *MemcachedCache) get(key string) (CachedResult, bool) {
+	item, err := m.client.Get(key)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Info("memcached cache get failed for ", key, ": ", err)
+		}
+		return CachedResult{}, false
+	}
+	res, err := decodeCachedResult(item.Value)
+	if err != nil {
+		log.Info("memcached cache decode failed for ", key, ": ", err)
+		return CachedResult{}, false
+	}
+	return res, true
+}
+
+func (m *MemcachedCache) put(key string, res CachedResult, expireAt time.Time) {
+	data, err := encodeCachedResult(res)
+	if err != nil {
+		log.Info("memcached cache encode failed for ", key, ": ", err)
+		return
+	}
+	ttl := time.Until(expireAt)
+	if ttl <= 0 {
+		return
+	}
+	err = m.client.Set(&memcache.Item{Key: key, Value: data, Expiration: memcachedExpiration(ttl, expireAt)})
+	if err != nil {
+		log.Info("memcached cache set failed for ", key, ": ", err)
+	}
+}
+
+// memcachedExpiration converts ttl (expiring at expireAt) into the Expiration value memcached's protocol
+// expects. Past memcachedMaxRelativeTTL, the protocol reinterprets Expiration as an absolute Unix timestamp
+// instead of a relative offset; send one explicitly rather than let a long TTL silently become "already
+// expired".
+func memcachedExpiration(ttl time.Duration, expireAt time.Time) int32 {
+	if ttl > memcachedMaxRelativeTTL {
+		return int32(expireAt.Unix())
+	}
+	return int32(ttl.Seconds())
+}
+
+// casUpdate performs an optimistic read-modify-write against key, using memcached's native CAS support (a
+// Get followed by a CompareAndSwap against the same *memcache.Item) so that if another worker's write
+// lands in between the read and the write, the CAS is rejected instead of one put() silently clobbering
+// the other's answer - mirroring the mutual exclusion MemoryCache gets from IterativeCache.Lock/Unlock
+// around the same kind of read-modify-write cycle. update receives the entry currently stored for key (the
+// zero value if absent) and returns the entry to write back, the TTL to set it with, and whether to write
+// at all - returning write=false (e.g. on a cache miss, or nothing left to persist) leaves key untouched.
+func (m *MemcachedCache) casUpdate(key string, update func(existing CachedResult, exists bool) (res CachedResult, expireAt time.Time, write bool)) error {
+	for attempt := 0; attempt < maxCASRetries; attempt++ {
+		item, getErr := m.client.Get(key)
+		exists := getErr == nil
+		if getErr != nil && getErr != memcache.ErrCacheMiss {
+			return fmt.Errorf("memcached cache get failed for %s: %w", key, getErr)
+		}
+		var existing CachedResult
+		if exists {
+			var decodeErr error
+			existing, decodeErr = decodeCachedResult(item.Value)
+			if decodeErr != nil {
+				log.Info("memcached cache decode failed for ", key, ": ", decodeErr)
+				exists = false
+			}
+		}
+		res, expireAt, write := update(existing, exists)
+		if !write {
+			return nil
+		}
+		data, err := encodeCachedResult(res)
+		if err != nil {
+			return fmt.Errorf("memcached cache encode failed for %s: %w", key, err)
+		}
+		ttl := time.Until(expireAt)
+		if ttl <= 0 {
+			return nil
+		}
+		expiration := memcachedExpiration(ttl, expireAt)
+
+		var casErr error
+		if exists {
+			// item is the exact object Get returned, carrying the CAS token the server handed back with
+			// it; CompareAndSwap only succeeds if nothing has written to key since.
+			item.Value = data
+			item.Expiration = expiration
+			casErr = m.client.CompareAndSwap(item)
+		} else {
+			// Add only succeeds if key is still absent, so a concurrent writer that created it first loses
+			// the race cleanly rather than being overwritten.
+			casErr = m.client.Add(&memcache.Item{Key: key, Value: data, Expiration: expiration})
+		}
+		switch casErr {
+		case nil:
+			return nil
+		case memcache.ErrCASConflict, memcache.ErrNotStored:
+			continue // another writer raced us between the read and the CAS/Add; retry the whole cycle
+		default:
+			return fmt.Errorf("memcached cache set failed for %s: %w", key, casErr)
+		}
+	}
+	return fmt.Errorf("memcached cache update for %s: too much contention after %d attempts", key, maxCASRetries)
+}
+
+func (m *MemcachedCache) AddCachedAnswer(answer interface{}, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
+	a, ok := answer.(Answer)
+	if !ok {
+		return
+	}
+	q := questionFromAnswer(a)
+	isCacheableType := q.Type == dns.TypeA || q.Type == dns.TypeAAAA || q.Type == dns.TypeNS || q.Type == dns.TypeDNAME || q.Type == dns.TypeCNAME
+	if !isCacheableType && !(dnssecOK && isDNSSECType(q.Type)) {
+		return
+	}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	key := memcachedKey(cacheKey)
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(time.Duration(a.TTL) * time.Second)
+	err := m.casUpdate(key, func(existing CachedResult, exists bool) (CachedResult, time.Time, bool) {
+		ca := existing
+		if !exists {
+			ca = CachedResult{}
+		}
+		// a positive entry supersedes any negative entry previously cached for this key; a negative entry
+		// carries no Answers map at all, so it must be (re-)initialized before being written into here.
+		ca.NegativeType = NegativeNone
+		if ca.Answers == nil {
+			ca.Answers = make(map[interface{}]TimedAnswer)
+		}
+		ca.Answers[a] = TimedAnswer{Answer: answer, ExpiresAt: expiresAt, IssuedAt: issuedAt}
+		// Keep the memcached entry alive through the serve-stale grace window, not just until the answer's
+		// own TTL expires, so GetCachedResult can still find (and flag) it as stale.
+		return ca, latestExpiry(ca.Answers).Add(m.MaxStaleTTL), true
+	})
+	if err != nil {
+		log.Info("memcached cache update failed for ", key, ": ", err)
+	}
+}
+
+// AddNegativeCachedAnswer caches an NXDOMAIN/NODATA response for q per RFC 2308, capped by MaxNegativeTTL.
+func (m *MemcachedCache) AddNegativeCachedAnswer(q Question, negType NegativeType, soa *dns.SOA, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
+	if soa == nil || negType == NegativeNone {
+		return
+	}
+	ttl := time.Duration(soa.Minttl) * time.Second
+	if m.MaxNegativeTTL != 0 && ttl > m.MaxNegativeTTL {
+		ttl = m.MaxNegativeTTL
+	}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	expireAt := time.Now().Add(ttl)
+	m.put(memcachedKey(cacheKey), CachedResult{NegativeType: negType, ExpiresAt: expireAt}, expireAt)
+}
+
+func (m *MemcachedCache) GetCachedResult(q Question, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) (SingleQueryResult, bool, NegativeType) {
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	key := memcachedKey(cacheKey)
+
+	// Populated by the casUpdate closure below; reset at the top of every invocation (including retries)
+	// so a value left over from an earlier, aborted attempt can never leak into the result returned here.
+	var (
+		retv           SingleQueryResult
+		hit            bool
+		negType        NegativeType
+		stale          bool
+		shouldPrefetch bool
+	)
+	err := m.casUpdate(key, func(existing CachedResult, exists bool) (CachedResult, time.Time, bool) {
+		retv = SingleQueryResult{}
+		hit, negType, stale, shouldPrefetch = false, NegativeNone, false, false
+		if !exists {
+			return CachedResult{}, time.Time{}, false
+		}
+		cachedRes := existing
+		if cachedRes.NegativeType != NegativeNone {
+			if cachedRes.ExpiresAt.Before(time.Now()) {
+				return cachedRes, time.Time{}, false
+			}
+			hit, negType = true, cachedRes.NegativeType
+			return cachedRes, time.Time{}, false
+		}
+		retv.Authorities = make([]interface{}, 0)
+		retv.Answers = make([]interface{}, 0)
+		retv.Additional = make([]interface{}, 0)
+
+		now := time.Now()
+		nearestToExpireFrac := 1.0
+		for k, ta := range cachedRes.Answers {
+			if ta.ExpiresAt.Before(now) {
+				if m.MaxStaleTTL > 0 && ta.ExpiresAt.Add(m.MaxStaleTTL).After(now) {
+					retv.Answers = append(retv.Answers, ta.Answer)
+					stale = true
+					continue
+				}
+				delete(cachedRes.Answers, k)
+				continue
+			}
+			retv.Answers = append(retv.Answers, ta.Answer)
+			if frac := remainingTTLFraction(ta, now); frac < nearestToExpireFrac {
+				nearestToExpireFrac = frac
+			}
+		}
+		if len(retv.Answers) == 0 {
+			retv = SingleQueryResult{}
+			return cachedRes, time.Time{}, false
+		}
+		hit = true
+		cachedRes.HitCount++
+		shouldPrefetch = !stale && cachedRes.HitCount >= m.PrefetchMinHits &&
+			nearestToExpireFrac*100 < float64(m.PrefetchThresholdPct)
+		// persist the pruned answers and bumped hit count, keeping the key alive through the stale window
+		return cachedRes, latestExpiry(cachedRes.Answers).Add(m.MaxStaleTTL), true
+	})
+	if err != nil {
+		log.Info("memcached cache update failed for ", key, ": ", err)
+	}
+	if !hit {
+		return SingleQueryResult{}, false, NegativeNone
+	}
+	if negType != NegativeNone {
+		return retv, true, negType
+	}
+	if ns != nil {
+		retv.Resolver = ns.String()
+	}
+	if stale {
+		retv.IsStale = true
+		m.prefetch.enqueue(cacheKey, q, ns, m.refresh, m.Stats)
+	} else if shouldPrefetch {
+		m.prefetch.enqueue(cacheKey, q, ns, m.refresh, m.Stats)
+	}
+	return retv, true, NegativeNone
+}
+
+func (m *MemcachedCache) SafeAddLayerNameServers(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
+	authsAndAdditionals := util.Concat(result.Authorities, result.Additional)
+	timedAns := make(map[interface{}]TimedAnswer, len(authsAndAdditionals))
+	for _, a := range authsAndAdditionals {
+		castAns, ok := a.(Answer)
+		if !ok {
+			continue
+		}
+		if castAns.RrType != dns.TypeNS && castAns.RrType != dns.TypeA && castAns.RrType != dns.TypeAAAA {
+			continue
+		}
+		timedAns[a] = TimedAnswer{Answer: a, ExpiresAt: time.Now().Add(time.Duration(castAns.TTL) * time.Second)}
+	}
+	if len(timedAns) == 0 {
+		return
+	}
+	cacheKey := CachedKey{Question: Question{Name: layer, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	m.put(memcachedKey(cacheKey), CachedResult{Answers: timedAns}, latestExpiry(timedAns))
+}
+
+func (m *MemcachedCache) GetLayerNameServers(name string, checkingDisabled, dnssecOK bool) (SingleQueryResult, bool) {
+	res := SingleQueryResult{}
+	res.Answers = make([]interface{}, 0)
+	res.Authorities = make([]interface{}, 0)
+	res.Additional = make([]interface{}, 0)
+	cacheKey := CachedKey{Question: Question{Name: name, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	cachedRes, ok := m.get(memcachedKey(cacheKey))
+	if !ok {
+		return SingleQueryResult{}, false
+	}
+	now := time.Now()
+	for _, ta := range cachedRes.Answers {
+		if ta.ExpiresAt.Before(now) {
+			continue
+		}
+		castAns, ok := ta.Answer.(Answer)
+		if !ok {
+			continue
+		}
+		if castAns.RrType == dns.TypeNS {
+			res.Authorities = append(res.Authorities, castAns)
+		} else if castAns.RrType == dns.TypeA || castAns.RrType == dns.TypeAAAA {
+			res.Additional = append(res.Additional, castAns)
+		}
+	}
+	return res, true
+}
+
+// SafeAddCachedAnswer mirrors MemoryCache.SafeAddCachedAnswer: it drops a would-be cache entry whose name
+// isn't beneath layer - e.g. off-path glue a malicious or misconfigured authority injected into its own
+// response - instead of caching it, so CacheUpdate can't be used to poison the cache.
+func (m *MemcachedCache) SafeAddCachedAnswer(a interface{}, ns *NameServer, layer, debugType string, checkingDisabled, dnssecOK bool, depth int) {
+	ans, ok := a.(Answer)
+	if !ok {
+		log.Info("unable to cast ", debugType, ": ", layer, ": ", a)
+		return
+	}
+	if ok, _ := nameIsBeneath(ans.Name, layer); !ok {
+		log.Info("detected poison ", debugType, ": ", ans.Name, "(", ans.Type, "): ", layer, ": ", a)
+		return
+	}
+	m.AddCachedAnswer(a, ns, checkingDisabled, dnssecOK, depth)
+}
+
+func (m *MemcachedCache) CacheUpdate(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
+	for _, a := range result.Additional {
+		m.SafeAddCachedAnswer(a, ns, layer, "additional", checkingDisabled, dnssecOK, depth)
+	}
+	for _, a := range result.Authorities {
+		m.SafeAddCachedAnswer(a, ns, layer, "authority", checkingDisabled, dnssecOK, depth)
+	}
+	if result.Flags.Authoritative || cacheNonAuthoritativeAns {
+		for _, a := range result.Answers {
+			m.SafeAddCachedAnswer(a, ns, layer, "answer", checkingDisabled, dnssecOK, depth)
+		}
+	}
+}
+
+// Snapshot is not supported on MemcachedCache: the memcached protocol has no key-enumeration primitive,
+// so there is no way to discover what's currently cached short of tracking every key this process itself
+// wrote (which wouldn't reflect what other workers sharing this backend have cached). Use RedisCache if
+// dumping a shared out-of-process cache is needed.
+func (m *MemcachedCache) Snapshot(path string) error {
+	return fmt.Errorf("memcached does not support key enumeration; cache dump is not available for this backend")
+}
+
+// Load reads a snapshot previously written by RedisCache.Snapshot or MemoryCache.Snapshot and writes its
+// entries into memcached, pruning anything already expired exactly as MemoryCache.Load does.
+func (m *MemcachedCache) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open snapshot %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if magic != snapshotMagic {
+		return fmt.Errorf("%s is not a zdns cache snapshot", path)
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	now := time.Now()
+	var loaded, dropped int
+	for {
+		key, value, err := readSnapshotEntry(r)
+		if err == errSnapshotEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read snapshot entry: %w", err)
+		}
+		cr, err := decodeCachedResult(value)
+		if err != nil {
+			log.Info("skipping corrupt snapshot entry for ", key.Question.Name, ": ", err)
+			dropped++
+			continue
+		}
+		var expireAt time.Time
+		if cr.NegativeType != NegativeNone {
+			if cr.ExpiresAt.Before(now) {
+				dropped++
+				continue
+			}
+			expireAt = cr.ExpiresAt
+		} else {
+			for k, ta := range cr.Answers {
+				if ta.ExpiresAt.Before(now) {
+					delete(cr.Answers, k)
+				}
+			}
+			if len(cr.Answers) == 0 {
+				dropped++
+				continue
+			}
+			expireAt = latestExpiry(cr.Answers).Add(m.MaxStaleTTL)
+		}
+		m.put(memcachedKey(key), cr, expireAt)
+		loaded++
+	}
+	log.Info("loaded ", loaded, " cache entries from snapshot ", path, " (", dropped, " dropped as expired)")
+	return nil
+}
@@ -0,0 +1,95 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import "sync"
+
+// defaultPrefetchWorkers bounds how many refresh-ahead lookups can be in flight at once, so a scan that
+// suddenly has many hot, near-expiry entries can't flood the iterative resolver with prefetch traffic.
+const defaultPrefetchWorkers = 8
+
+// defaultPrefetchQueueSize bounds how many prefetch jobs can be queued before new ones are dropped rather
+// than blocking the caller that triggered them.
+const defaultPrefetchQueueSize = 1024
+
+type prefetchJob struct {
+	key     CachedKey
+	q       Question
+	ns      *NameServer
+	refresh func(q Question, ns *NameServer)
+	stats   *CacheStatistics
+}
+
+// prefetchPool runs a bounded pool of workers that re-resolve hot, about-to-expire cache entries ahead of
+// their expiration. Jobs are deduplicated by CachedKey so a burst of hits on the same entry enqueues at
+// most one in-flight refresh.
+type prefetchPool struct {
+	once    sync.Once
+	jobs    chan prefetchJob
+	mu      sync.Mutex
+	pending map[CachedKey]bool
+}
+
+func (p *prefetchPool) start() {
+	p.once.Do(func() {
+		p.jobs = make(chan prefetchJob, defaultPrefetchQueueSize)
+		p.pending = make(map[CachedKey]bool)
+		for i := 0; i < defaultPrefetchWorkers; i++ {
+			go p.worker()
+		}
+	})
+}
+
+// enqueue schedules a refresh-ahead for key, unless one is already pending or refresh is unset. Safe to
+// call before start (e.g. Init not yet run): the job is simply dropped in that case.
+func (p *prefetchPool) enqueue(key CachedKey, q Question, ns *NameServer, refresh func(q Question, ns *NameServer), stats *CacheStatistics) {
+	if refresh == nil || p.jobs == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.pending[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.pending[key] = true
+	p.mu.Unlock()
+
+	select {
+	case p.jobs <- prefetchJob{key: key, q: q, ns: ns, refresh: refresh, stats: stats}:
+	default:
+		// queue is full; drop the prefetch rather than block the lookup that triggered it
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+	}
+}
+
+func (p *prefetchPool) worker() {
+	for job := range p.jobs {
+		func() {
+			defer func() {
+				p.mu.Lock()
+				delete(p.pending, job.key)
+				p.mu.Unlock()
+				if r := recover(); r != nil && job.stats != nil {
+					job.stats.IncrementPrefetchFailures()
+				}
+			}()
+			job.refresh(job.q, job.ns)
+			if job.stats != nil {
+				job.stats.IncrementPrefetches()
+			}
+		}()
+	}
+}
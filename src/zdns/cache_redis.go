@@ -0,0 +1,513 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/zmap/dns"
+	"github.com/zmap/zdns/src/internal/util"
+)
+
+// RedisCache is a Cache backend that stores the iterative cache out-of-process in Redis, so that
+// multiple zdns workers scanning from different hosts can share a single warm cache. Keys are hash-tagged
+// on the question name ("{qname}") so that all entries for a name land on the same Redis Cluster slot.
+type RedisCache struct {
+	client *redis.Client
+
+	// MaxStaleTTL and MaxNegativeTTL mirror MemoryCache's fields of the same name: they bound how long an
+	// expired entry may still be served under RFC 8767 serve-stale, and cap the TTL of cached negative
+	// responses. Zero MaxStaleTTL disables serve-stale. Left zero, NewRedisCache fills in the same
+	// defaults MemoryCache.Init uses.
+	MaxStaleTTL    time.Duration
+	MaxNegativeTTL time.Duration
+
+	// refresh, when set via SetRefreshFunc, asynchronously re-resolves a stale or about-to-expire entry.
+	refresh func(q Question, ns *NameServer)
+
+	// PrefetchThresholdPct and PrefetchMinHits gate refresh-ahead, exactly as on MemoryCache. Left zero,
+	// NewRedisCache fills in the same defaults.
+	PrefetchThresholdPct int
+	PrefetchMinHits      uint64
+	// Stats, if set, receives Prefetches/PrefetchFailures counts, exactly as MemoryCache does. Hits/Misses/
+	// Adds aren't wired on any backend yet - see the commented-out counters on MemoryCache - so RedisCache
+	// doesn't increment them either, to avoid the two backends diverging or double-counting once that
+	// wiring lands.
+	Stats *CacheStatistics
+
+	prefetch prefetchPool
+}
+
+// maxCASRetries bounds how many times AddCachedAnswer/GetCachedResult retry their optimistic
+// read-modify-write cycle against Redis (RedisCache.casUpdate) or memcached (MemcachedCache.casUpdate)
+// before giving up under sustained contention on the same key.
+const maxCASRetries = 5
+
+// NewRedisCache dials addr ("host:port") and returns a ready-to-use RedisCache.
+func NewRedisCache(addr string) (*RedisCache, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("connect to redis at %s: %w", addr, err)
+	}
+	r := &RedisCache{
+		client:               client,
+		MaxStaleTTL:          defaultMaxStaleTTL,
+		MaxNegativeTTL:       defaultMaxNegativeTTL,
+		PrefetchThresholdPct: defaultPrefetchThresholdPct,
+		PrefetchMinHits:      defaultPrefetchMinHits,
+	}
+	r.prefetch.start()
+	return r, nil
+}
+
+// SetRefreshFunc registers the callback used to asynchronously re-resolve a stale entry served under RFC
+// 8767, or a hot entry eligible for refresh-ahead. Safe to leave unset.
+func (r *RedisCache) SetRefreshFunc(refresh func(q Question, ns *NameServer)) {
+	r.refresh = refresh
+}
+
+func redisKey(k CachedKey) string {
+	// the qname goes inside the hash tag so co-located lookups for the same name share a cluster slot
+	return fmt.Sprintf("zdns:cache:{%s}:%d:%s:%v:%v:%v", k.Question.Name, k.Question.Type, k.NameServer, k.IsAuthority, k.CheckingDisabled, k.DNSSECOK)
+}
+
+// get returns the CachedKey alongside the CachedResult, rather than just the latter, so that Snapshot can
+// recover the original key for each entry it finds while scanning the keyspace: the Redis key itself is a
+// hash-tagged string, not a serialized CachedKey. cmd is a redis.Client for a plain read, or a redis.Tx
+// when called from inside casUpdate's optimistic transaction.
+func (r *RedisCache) get(ctx context.Context, cmd redis.Cmdable, key string) (CachedKey, CachedResult, bool) {
+	data, err := cmd.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Info("redis cache get failed for ", key, ": ", err)
+		}
+		return CachedKey{}, CachedResult{}, false
+	}
+	ck, res, err := decodeCacheEntry(data)
+	if err != nil {
+		log.Info("redis cache decode failed for ", key, ": ", err)
+		return CachedKey{}, CachedResult{}, false
+	}
+	return ck, res, true
+}
+
+// put writes (ck, res) to key, setting the server-side TTL to expireAt so Redis reaps the entry itself
+// instead of relying on a reader to notice it's expired. Unlike casUpdate, this is a blind overwrite with
+// no regard for what's currently stored - only safe for callers (AddNegativeCachedAnswer,
+// SafeAddLayerNameServers) that replace a key's value wholesale rather than reading, merging, and writing
+// it back.
+func (r *RedisCache) put(ctx context.Context, key string, ck CachedKey, res CachedResult, expireAt time.Time) {
+	data, err := encodeCacheEntry(ck, res)
+	if err != nil {
+		log.Info("redis cache encode failed for ", key, ": ", err)
+		return
+	}
+	ttl := time.Until(expireAt)
+	if ttl <= 0 {
+		return
+	}
+	if err := r.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		log.Info("redis cache set failed for ", key, ": ", err)
+	}
+}
+
+// casUpdate performs an optimistic read-modify-write against key, mirroring the mutual exclusion
+// MemoryCache gets from IterativeCache.Lock/Unlock around the same kind of read-modify-write cycle: it
+// WATCHes key so that if another worker's write lands in between the read and the write, the transaction
+// aborts instead of one put() silently clobbering the other's answer, and the whole cycle (including the
+// caller-supplied update) is retried against the now-current value. update receives the entry currently
+// stored for key (the zero value if absent) and returns the entry to write back, the TTL to set it with,
+// and whether to write at all - returning write=false (e.g. on a cache miss, or nothing left to persist)
+// leaves key untouched.
+func (r *RedisCache) casUpdate(ctx context.Context, key string, ck CachedKey, update func(existing CachedResult, exists bool) (res CachedResult, expireAt time.Time, write bool)) error {
+	for attempt := 0; attempt < maxCASRetries; attempt++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			_, existing, exists := r.get(ctx, tx, key)
+			res, expireAt, write := update(existing, exists)
+			if !write {
+				return nil
+			}
+			data, err := encodeCacheEntry(ck, res)
+			if err != nil {
+				return err
+			}
+			ttl := time.Until(expireAt)
+			if ttl <= 0 {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, ttl)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue // another writer raced us between the read and the commit; retry the whole cycle
+		}
+		return err
+	}
+	return fmt.Errorf("redis cache update for %s: too much contention after %d attempts", key, maxCASRetries)
+}
+
+func latestExpiry(answers map[interface{}]TimedAnswer) time.Time {
+	var latest time.Time
+	for _, ta := range answers {
+		if ta.ExpiresAt.After(latest) {
+			latest = ta.ExpiresAt
+		}
+	}
+	return latest
+}
+
+func (r *RedisCache) AddCachedAnswer(answer interface{}, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
+	a, ok := answer.(Answer)
+	if !ok {
+		return
+	}
+	q := questionFromAnswer(a)
+	isCacheableType := q.Type == dns.TypeA || q.Type == dns.TypeAAAA || q.Type == dns.TypeNS || q.Type == dns.TypeDNAME || q.Type == dns.TypeCNAME
+	if !isCacheableType && !(dnssecOK && isDNSSECType(q.Type)) {
+		return
+	}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	key := redisKey(cacheKey)
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(time.Duration(a.TTL) * time.Second)
+	err := r.casUpdate(context.Background(), key, cacheKey, func(existing CachedResult, exists bool) (CachedResult, time.Time, bool) {
+		ca := existing
+		if !exists {
+			ca = CachedResult{}
+		}
+		// a positive entry supersedes any negative entry previously cached for this key; a negative entry
+		// carries no Answers map at all, so it must be (re-)initialized before being written into here.
+		ca.NegativeType = NegativeNone
+		if ca.Answers == nil {
+			ca.Answers = make(map[interface{}]TimedAnswer)
+		}
+		ca.Answers[a] = TimedAnswer{Answer: answer, ExpiresAt: expiresAt, IssuedAt: issuedAt}
+		// Keep the Redis key alive through the serve-stale grace window, not just until the answer's own
+		// TTL expires, so GetCachedResult can still find (and flag) it as stale instead of it simply
+		// vanishing.
+		return ca, latestExpiry(ca.Answers).Add(r.MaxStaleTTL), true
+	})
+	if err != nil {
+		log.Info("redis cache update failed for ", key, ": ", err)
+	}
+}
+
+// AddNegativeCachedAnswer caches an NXDOMAIN/NODATA response for q per RFC 2308, capped by MaxNegativeTTL.
+func (r *RedisCache) AddNegativeCachedAnswer(q Question, negType NegativeType, soa *dns.SOA, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) {
+	if soa == nil || negType == NegativeNone {
+		return
+	}
+	ttl := time.Duration(soa.Minttl) * time.Second
+	if r.MaxNegativeTTL != 0 && ttl > r.MaxNegativeTTL {
+		ttl = r.MaxNegativeTTL
+	}
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	expireAt := time.Now().Add(ttl)
+	r.put(context.Background(), redisKey(cacheKey), cacheKey, CachedResult{NegativeType: negType, ExpiresAt: expireAt}, expireAt)
+}
+
+func (r *RedisCache) GetCachedResult(q Question, ns *NameServer, checkingDisabled, dnssecOK bool, depth int) (SingleQueryResult, bool, NegativeType) {
+	cacheKey := CachedKey{Question: q, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	if ns != nil {
+		cacheKey.NameServer = ns.String()
+	}
+	key := redisKey(cacheKey)
+
+	// Populated by the casUpdate closure below; reset at the top of every invocation (including retries)
+	// so a value left over from an earlier, aborted attempt can never leak into the result returned here.
+	var (
+		retv           SingleQueryResult
+		hit            bool
+		negType        NegativeType
+		stale          bool
+		shouldPrefetch bool
+	)
+	err := r.casUpdate(context.Background(), key, cacheKey, func(existing CachedResult, exists bool) (CachedResult, time.Time, bool) {
+		retv = SingleQueryResult{}
+		hit, negType, stale, shouldPrefetch = false, NegativeNone, false, false
+		if !exists {
+			return CachedResult{}, time.Time{}, false
+		}
+		cachedRes := existing
+		if cachedRes.NegativeType != NegativeNone {
+			if cachedRes.ExpiresAt.Before(time.Now()) {
+				return cachedRes, time.Time{}, false
+			}
+			hit, negType = true, cachedRes.NegativeType
+			return cachedRes, time.Time{}, false
+		}
+		retv.Authorities = make([]interface{}, 0)
+		retv.Answers = make([]interface{}, 0)
+		retv.Additional = make([]interface{}, 0)
+
+		now := time.Now()
+		nearestToExpireFrac := 1.0
+		for k, ta := range cachedRes.Answers {
+			if ta.ExpiresAt.Before(now) {
+				if r.MaxStaleTTL > 0 && ta.ExpiresAt.Add(r.MaxStaleTTL).After(now) {
+					retv.Answers = append(retv.Answers, ta.Answer)
+					stale = true
+					continue
+				}
+				delete(cachedRes.Answers, k)
+				continue
+			}
+			retv.Answers = append(retv.Answers, ta.Answer)
+			if frac := remainingTTLFraction(ta, now); frac < nearestToExpireFrac {
+				nearestToExpireFrac = frac
+			}
+		}
+		if len(retv.Answers) == 0 {
+			retv = SingleQueryResult{}
+			return cachedRes, time.Time{}, false
+		}
+		hit = true
+		cachedRes.HitCount++
+		shouldPrefetch = !stale && cachedRes.HitCount >= r.PrefetchMinHits &&
+			nearestToExpireFrac*100 < float64(r.PrefetchThresholdPct)
+		// persist the pruned answers and bumped hit count, keeping the key alive through the stale window
+		return cachedRes, latestExpiry(cachedRes.Answers).Add(r.MaxStaleTTL), true
+	})
+	if err != nil {
+		log.Info("redis cache update failed for ", key, ": ", err)
+	}
+	if !hit {
+		return SingleQueryResult{}, false, NegativeNone
+	}
+	if negType != NegativeNone {
+		return retv, true, negType
+	}
+	if ns != nil {
+		retv.Resolver = ns.String()
+	}
+	if stale {
+		retv.IsStale = true
+		r.prefetch.enqueue(cacheKey, q, ns, r.refresh, r.Stats)
+	} else if shouldPrefetch {
+		r.prefetch.enqueue(cacheKey, q, ns, r.refresh, r.Stats)
+	}
+	return retv, true, NegativeNone
+}
+
+func (r *RedisCache) SafeAddLayerNameServers(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
+	authsAndAdditionals := util.Concat(result.Authorities, result.Additional)
+	timedAns := make(map[interface{}]TimedAnswer, len(authsAndAdditionals))
+	for _, a := range authsAndAdditionals {
+		castAns, ok := a.(Answer)
+		if !ok {
+			continue
+		}
+		if castAns.RrType != dns.TypeNS && castAns.RrType != dns.TypeA && castAns.RrType != dns.TypeAAAA {
+			continue
+		}
+		timedAns[a] = TimedAnswer{Answer: a, ExpiresAt: time.Now().Add(time.Duration(castAns.TTL) * time.Second)}
+	}
+	if len(timedAns) == 0 {
+		return
+	}
+	cacheKey := CachedKey{Question: Question{Name: layer, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	r.put(context.Background(), redisKey(cacheKey), cacheKey, CachedResult{Answers: timedAns}, latestExpiry(timedAns))
+}
+
+func (r *RedisCache) GetLayerNameServers(name string, checkingDisabled, dnssecOK bool) (SingleQueryResult, bool) {
+	res := SingleQueryResult{}
+	res.Answers = make([]interface{}, 0)
+	res.Authorities = make([]interface{}, 0)
+	res.Additional = make([]interface{}, 0)
+	cacheKey := CachedKey{Question: Question{Name: name, Type: dns.TypeNS}, IsAuthority: true, CheckingDisabled: checkingDisabled, DNSSECOK: dnssecOK}
+	_, cachedRes, ok := r.get(context.Background(), r.client, redisKey(cacheKey))
+	if !ok {
+		return SingleQueryResult{}, false
+	}
+	now := time.Now()
+	for _, ta := range cachedRes.Answers {
+		if ta.ExpiresAt.Before(now) {
+			continue
+		}
+		castAns, ok := ta.Answer.(Answer)
+		if !ok {
+			continue
+		}
+		if castAns.RrType == dns.TypeNS {
+			res.Authorities = append(res.Authorities, castAns)
+		} else if castAns.RrType == dns.TypeA || castAns.RrType == dns.TypeAAAA {
+			res.Additional = append(res.Additional, castAns)
+		}
+	}
+	return res, true
+}
+
+// SafeAddCachedAnswer mirrors MemoryCache.SafeAddCachedAnswer: it drops a would-be cache entry whose name
+// isn't beneath layer - e.g. off-path glue a malicious or misconfigured authority injected into its own
+// response - instead of caching it, so CacheUpdate can't be used to poison the cache.
+func (r *RedisCache) SafeAddCachedAnswer(a interface{}, ns *NameServer, layer, debugType string, checkingDisabled, dnssecOK bool, depth int) {
+	ans, ok := a.(Answer)
+	if !ok {
+		log.Info("unable to cast ", debugType, ": ", layer, ": ", a)
+		return
+	}
+	if ok, _ := nameIsBeneath(ans.Name, layer); !ok {
+		log.Info("detected poison ", debugType, ": ", ans.Name, "(", ans.Type, "): ", layer, ": ", a)
+		return
+	}
+	r.AddCachedAnswer(a, ns, checkingDisabled, dnssecOK, depth)
+}
+
+func (r *RedisCache) CacheUpdate(layer string, result SingleQueryResult, ns *NameServer, checkingDisabled, dnssecOK bool, depth int, cacheNonAuthoritativeAns bool) {
+	for _, a := range result.Additional {
+		r.SafeAddCachedAnswer(a, ns, layer, "additional", checkingDisabled, dnssecOK, depth)
+	}
+	for _, a := range result.Authorities {
+		r.SafeAddCachedAnswer(a, ns, layer, "authority", checkingDisabled, dnssecOK, depth)
+	}
+	if result.Flags.Authoritative || cacheNonAuthoritativeAns {
+		for _, a := range result.Answers {
+			r.SafeAddCachedAnswer(a, ns, layer, "answer", checkingDisabled, dnssecOK, depth)
+		}
+	}
+}
+
+// Snapshot walks every "zdns:cache:*" key currently held by this backend's Redis instance and writes them
+// to path in the same (CachedKey, CachedResult) format MemoryCache.Snapshot produces, so a Redis-backed
+// scan's shared cache can be dumped for inspection or to warm-start a different backend. Unlike
+// MemoryCache, this reads the actual out-of-process shared cache rather than anything process-local, so
+// it reflects whatever every worker writing to this Redis instance has contributed.
+func (r *RedisCache) Snapshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create snapshot %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(snapshotMagic[:]); err != nil {
+		return fmt.Errorf("write snapshot header: %w", err)
+	}
+	if err := w.WriteByte(snapshotVersion); err != nil {
+		return fmt.Errorf("write snapshot header: %w", err)
+	}
+
+	ctx := context.Background()
+	var count int
+	iter := r.client.Scan(ctx, 0, "zdns:cache:*", 0).Iterator()
+	for iter.Next(ctx) {
+		ck, cr, ok := r.get(ctx, r.client, iter.Val())
+		if !ok {
+			continue
+		}
+		data, err := encodeCachedResult(cr)
+		if err != nil {
+			log.Info("skipping unencodable cache entry ", ck, ": ", err)
+			continue
+		}
+		if err := writeSnapshotEntry(w, ck, data); err != nil {
+			return fmt.Errorf("write snapshot entry: %w", err)
+		}
+		count++
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("scan redis keyspace: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush snapshot %s: %w", path, err)
+	}
+	log.Info("wrote ", count, " cache entries to snapshot ", path)
+	return nil
+}
+
+// Load reads a snapshot previously written by Snapshot (from either backend) and writes its entries into
+// this Redis instance, pruning anything already expired exactly as MemoryCache.Load does.
+func (r *RedisCache) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open snapshot %s: %w", path, err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var magic [8]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if magic != snapshotMagic {
+		return fmt.Errorf("%s is not a zdns cache snapshot", path)
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	var loaded, dropped int
+	for {
+		key, value, err := readSnapshotEntry(br)
+		if err == errSnapshotEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read snapshot entry: %w", err)
+		}
+		cr, err := decodeCachedResult(value)
+		if err != nil {
+			log.Info("skipping corrupt snapshot entry for ", key.Question.Name, ": ", err)
+			dropped++
+			continue
+		}
+		var expireAt time.Time
+		if cr.NegativeType != NegativeNone {
+			if cr.ExpiresAt.Before(now) {
+				dropped++
+				continue
+			}
+			expireAt = cr.ExpiresAt
+		} else {
+			for k, ta := range cr.Answers {
+				if ta.ExpiresAt.Before(now) {
+					delete(cr.Answers, k)
+				}
+			}
+			if len(cr.Answers) == 0 {
+				dropped++
+				continue
+			}
+			expireAt = latestExpiry(cr.Answers).Add(r.MaxStaleTTL)
+		}
+		r.put(ctx, redisKey(key), key, cr, expireAt)
+		loaded++
+	}
+	log.Info("loaded ", loaded, " cache entries from snapshot ", path, " (", dropped, " dropped as expired)")
+	return nil
+}
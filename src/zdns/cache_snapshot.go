@@ -0,0 +1,225 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotMagic identifies a zdns cache snapshot file, and snapshotVersion is bumped whenever the entry
+// layout below changes in a way Load can't infer on its own.
+var snapshotMagic = [8]byte{'Z', 'D', 'N', 'S', 'C', 'A', 'C', 'H'}
+
+const snapshotVersion = 1
+
+var errSnapshotEOF = errors.New("snapshot EOF")
+
+// Snapshot walks every entry currently held by the cache - iterative and authority alike - and writes
+// them to path as a sequence of length-prefixed (CachedKey, CachedResult) pairs behind a versioned
+// header, so a later Load (on this host, or a freshly started worker) can resume with a warm cache.
+func (s *MemoryCache) Snapshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create snapshot %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(snapshotMagic[:]); err != nil {
+		return fmt.Errorf("write snapshot header: %w", err)
+	}
+	if err := w.WriteByte(snapshotVersion); err != nil {
+		return fmt.Errorf("write snapshot header: %w", err)
+	}
+
+	var count int
+	var writeErr error
+	s.IterativeCache.Range(func(key, value interface{}) bool {
+		ck, ok := key.(CachedKey)
+		if !ok {
+			return true
+		}
+		cr, ok := value.(CachedResult)
+		if !ok {
+			return true
+		}
+		data, err := encodeCachedResult(cr)
+		if err != nil {
+			log.Info("skipping unencodable cache entry ", ck, ": ", err)
+			return true
+		}
+		if err := writeSnapshotEntry(w, ck, data); err != nil {
+			writeErr = err
+			return false
+		}
+		count++
+		return true
+	})
+	if writeErr != nil {
+		return fmt.Errorf("write snapshot entry: %w", writeErr)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush snapshot %s: %w", path, err)
+	}
+	log.Info("wrote ", count, " cache entries to snapshot ", path)
+	return nil
+}
+
+func writeSnapshotEntry(w *bufio.Writer, key CachedKey, value []byte) error {
+	var keyBuf bytes.Buffer
+	if err := gob.NewEncoder(&keyBuf).Encode(key); err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(keyBuf.Len())); err != nil {
+		return err
+	}
+	if _, err := w.Write(keyBuf.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(value))); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+func readSnapshotEntry(r *bufio.Reader) (CachedKey, []byte, error) {
+	var keyLen uint32
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		// binary.Read only returns io.EOF when nothing at all could be read, i.e. a clean end of the
+		// entry stream; a torn read (truncation, corruption, a real I/O error) comes back as
+		// io.ErrUnexpectedEOF or something else, and must not be mistaken for a normal end of file.
+		if err == io.EOF {
+			return CachedKey{}, nil, errSnapshotEOF
+		}
+		return CachedKey{}, nil, fmt.Errorf("read snapshot entry header: %w", err)
+	}
+	keyBuf := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, keyBuf); err != nil {
+		return CachedKey{}, nil, fmt.Errorf("truncated snapshot key: %w", err)
+	}
+	var key CachedKey
+	if err := gob.NewDecoder(bytes.NewReader(keyBuf)).Decode(&key); err != nil {
+		return CachedKey{}, nil, fmt.Errorf("decode key: %w", err)
+	}
+
+	var valLen uint32
+	if err := binary.Read(r, binary.BigEndian, &valLen); err != nil {
+		return CachedKey{}, nil, fmt.Errorf("truncated snapshot entry: %w", err)
+	}
+	valBuf := make([]byte, valLen)
+	if _, err := io.ReadFull(r, valBuf); err != nil {
+		return CachedKey{}, nil, fmt.Errorf("truncated snapshot value: %w", err)
+	}
+	return key, valBuf, nil
+}
+
+// Load reads a snapshot previously written by Snapshot and merges it into the cache. Entries whose
+// ExpiresAt has already passed are dropped outright; a positive entry whose Answers map contains a mix of
+// still-live and already-expired TimedAnswers has the expired ones pruned rather than being dropped
+// wholesale.
+func (s *MemoryCache) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open snapshot %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if magic != snapshotMagic {
+		return fmt.Errorf("%s is not a zdns cache snapshot", path)
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read snapshot header: %w", err)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	now := time.Now()
+	var loaded, dropped int
+	for {
+		key, value, err := readSnapshotEntry(r)
+		if err == errSnapshotEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read snapshot entry: %w", err)
+		}
+		cr, err := decodeCachedResult(value)
+		if err != nil {
+			log.Info("skipping corrupt snapshot entry for ", key.Question.Name, ": ", err)
+			dropped++
+			continue
+		}
+		if cr.NegativeType != NegativeNone {
+			if cr.ExpiresAt.Before(now) {
+				dropped++
+				continue
+			}
+		} else {
+			for k, ta := range cr.Answers {
+				if ta.ExpiresAt.Before(now) {
+					delete(cr.Answers, k)
+				}
+			}
+			if len(cr.Answers) == 0 {
+				dropped++
+				continue
+			}
+		}
+		s.IterativeCache.Lock(key)
+		s.IterativeCache.Add(key, cr)
+		s.IterativeCache.Unlock(key)
+		loaded++
+	}
+	log.Info("loaded ", loaded, " cache entries from snapshot ", path, " (", dropped, " dropped as expired)")
+	return nil
+}
+
+// StartAutoSnapshot periodically writes the cache to path every interval, so a crashed or killed scan
+// doesn't lose the iterative work it already did. The returned func stops the background ticker.
+func (s *MemoryCache) StartAutoSnapshot(path string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Snapshot(path); err != nil {
+					log.Info("periodic cache snapshot failed: ", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
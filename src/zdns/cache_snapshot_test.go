@@ -0,0 +1,117 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zmap/dns"
+)
+
+// TestSnapshotRoundTripRRTypes covers round-trip fidelity across every RR type AddCachedAnswer accepts
+// with DO=0: A, AAAA, NS, CNAME, and DNAME. The DNSSEC types it accepts only under DO=1 are not covered.
+func TestSnapshotRoundTripRRTypes(t *testing.T) {
+	rrTypes := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeNS, dns.TypeCNAME, dns.TypeDNAME}
+
+	src := &MemoryCache{}
+	src.Init(100)
+	for i, rrType := range rrTypes {
+		ans := Answer{Name: "example.com.", RrType: rrType, TTL: 300}
+		src.AddCachedAnswer(ans, nil, false, false, i)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.bin")
+	if err := src.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := &MemoryCache{}
+	dst.Init(100)
+	if err := dst.Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	for _, rrType := range rrTypes {
+		q := Question{Name: "example.com.", Type: rrType}
+		res, hit, negType := dst.GetCachedResult(q, nil, false, false, 0)
+		if !hit {
+			t.Errorf("RR type %d: no hit after round trip", rrType)
+			continue
+		}
+		if negType != NegativeNone {
+			t.Errorf("RR type %d: unexpected negative type %v", rrType, negType)
+		}
+		if len(res.Answers) != 1 {
+			t.Errorf("RR type %d: expected 1 answer after round trip, got %d", rrType, len(res.Answers))
+		}
+	}
+}
+
+// TestSnapshotRoundTripNegative covers round-trip fidelity for a cached negative (NXDOMAIN) response.
+func TestSnapshotRoundTripNegative(t *testing.T) {
+	src := &MemoryCache{}
+	src.Init(100)
+	q := Question{Name: "nxdomain.example.com.", Type: dns.TypeA}
+	soa := &dns.SOA{Minttl: 300}
+	src.AddNegativeCachedAnswer(q, NegativeNXDomain, soa, nil, false, false, 0)
+
+	path := filepath.Join(t.TempDir(), "snapshot.bin")
+	if err := src.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := &MemoryCache{}
+	dst.Init(100)
+	if err := dst.Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	_, hit, negType := dst.GetCachedResult(q, nil, false, false, 0)
+	if !hit || negType != NegativeNXDomain {
+		t.Errorf("expected a NegativeNXDomain hit after round trip, got hit=%v negType=%v", hit, negType)
+	}
+}
+
+// TestLoadRejectsTruncatedSnapshot exercises the fix that distinguishes a genuinely truncated/corrupt
+// snapshot file from a clean end of file: truncating mid-entry must surface an error, not be silently
+// treated as having reached the end of a valid snapshot.
+func TestLoadRejectsTruncatedSnapshot(t *testing.T) {
+	src := &MemoryCache{}
+	src.Init(100)
+	src.AddCachedAnswer(Answer{Name: "example.com.", RrType: dns.TypeA, TTL: 300}, nil, false, false, 0)
+
+	path := filepath.Join(t.TempDir(), "snapshot.bin")
+	if err := src.Snapshot(path); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	// Chop off the tail so the last entry's length-prefixed payload is torn mid-read, rather than the file
+	// ending cleanly on an entry boundary.
+	truncated := data[:len(data)-2]
+	if err := os.WriteFile(path, truncated, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dst := &MemoryCache{}
+	dst.Init(100)
+	if err := dst.Load(path); err == nil {
+		t.Error("Load on a truncated snapshot returned nil error, want an error")
+	}
+}
@@ -25,6 +25,8 @@ type CacheStatistics struct {
 	Misses                  atomic.Uint64 // number of reads to the cache that result in a miss
 	Adds                    atomic.Uint64 // number of writes to the cache
 	Ejects                  atomic.Uint64 // number of cache entries that are ejected due to insertions
+	Prefetches              atomic.Uint64 // number of background refreshes (refresh-ahead or serve-stale) that returned without panicking
+	PrefetchFailures        atomic.Uint64 // number of background refreshes (refresh-ahead or serve-stale) that panicked
 }
 
 func (s *CacheStatistics) IncrementHits() {
@@ -51,13 +53,27 @@ func (s *CacheStatistics) IncrementEjects() {
 	}
 }
 
+func (s *CacheStatistics) IncrementPrefetches() {
+	if s.ShouldCaptureStatistics {
+		s.Prefetches.Add(1)
+	}
+}
+
+func (s *CacheStatistics) IncrementPrefetchFailures() {
+	if s.ShouldCaptureStatistics {
+		s.PrefetchFailures.Add(1)
+	}
+}
+
 func (s *CacheStatistics) PrintStatistics() {
 	hits := s.Hits.Load()
 	misses := s.Misses.Load()
 	adds := s.Adds.Load()
 	ejects := s.Ejects.Load()
+	prefetches := s.Prefetches.Load()
+	prefetchFailures := s.PrefetchFailures.Load()
 	total := hits + misses
 	hitRate := float64(hits) / float64(total)
 	missRate := float64(misses) / float64(total)
-	fmt.Printf("Cache statistics: hits=%d misses=%d adds=%d ejects=%d hitRate=%f missRate=%f\n", hits, misses, adds, ejects, hitRate, missRate)
+	fmt.Printf("Cache statistics: hits=%d misses=%d adds=%d ejects=%d prefetches=%d prefetchFailures=%d hitRate=%f missRate=%f\n", hits, misses, adds, ejects, prefetches, prefetchFailures, hitRate, missRate)
 }
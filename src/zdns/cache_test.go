@@ -0,0 +1,85 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zmap/dns"
+)
+
+// TestCacheKeyedByCheckingDisabledAndDNSSECOK covers the four (CD, DO) combinations: an answer cached
+// under one combination must only ever be served back to a lookup with that exact combination, never to
+// any of the other three.
+func TestCacheKeyedByCheckingDisabledAndDNSSECOK(t *testing.T) {
+	combos := []struct{ cd, do bool }{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	}
+
+	for _, stored := range combos {
+		t.Run(fmt.Sprintf("stored_cd=%v_do=%v", stored.cd, stored.do), func(t *testing.T) {
+			c := &MemoryCache{}
+			c.Init(100)
+
+			ans := Answer{Name: "example.com.", RrType: dns.TypeA, TTL: 300}
+			c.AddCachedAnswer(ans, nil, stored.cd, stored.do, 0)
+			q := Question{Name: "example.com.", Type: dns.TypeA}
+
+			for _, probe := range combos {
+				res, hit, negType := c.GetCachedResult(q, nil, probe.cd, probe.do, 0)
+				wantHit := probe.cd == stored.cd && probe.do == stored.do
+				if hit != wantHit {
+					t.Errorf("probe cd=%v/do=%v: hit=%v, want %v", probe.cd, probe.do, hit, wantHit)
+					continue
+				}
+				if wantHit {
+					if negType != NegativeNone {
+						t.Errorf("unexpected negative type %v for a positive entry", negType)
+					}
+					if len(res.Answers) != 1 {
+						t.Errorf("expected 1 cached answer, got %d", len(res.Answers))
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestCacheDNSSECTypeRequiresDO ensures a DNSSEC RR (RRSIG; NSEC and NSEC3 are not exercised) is only
+// cached, and only ever returned, for a query that set DO=1 - caching it for a DO=0 query would leak
+// DNSSEC RRs to a non-validating lookup.
+func TestCacheDNSSECTypeRequiresDO(t *testing.T) {
+	c := &MemoryCache{}
+	c.Init(100)
+
+	rrsig := Answer{Name: "example.com.", RrType: dns.TypeRRSIG, TTL: 300}
+	q := Question{Name: "example.com.", Type: dns.TypeRRSIG}
+
+	c.AddCachedAnswer(rrsig, nil, false, false, 0)
+	if _, hit, _ := c.GetCachedResult(q, nil, false, false, 0); hit {
+		t.Error("RRSIG was cached despite DO=0")
+	}
+
+	c.AddCachedAnswer(rrsig, nil, false, true, 0)
+	if _, hit, _ := c.GetCachedResult(q, nil, false, true, 0); !hit {
+		t.Error("RRSIG was not cached despite DO=1")
+	}
+	if _, hit, _ := c.GetCachedResult(q, nil, false, false, 0); hit {
+		t.Error("RRSIG cached under DO=1 leaked to a DO=0 lookup")
+	}
+}
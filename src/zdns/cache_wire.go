@@ -0,0 +1,91 @@
+/* ZDNS Copyright 2024 Regents of the University of Michigan
+*
+* Licensed under the Apache License, Version 2.0 (the "License"); you may not
+* use this file except in compliance with the License. You may obtain a copy
+* of the License at http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+* implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package zdns
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// cacheWireVersion is bumped whenever the gob-encoded CachedResult layout changes in a way that isn't
+// self-describing, so a RedisCache/MemcachedCache pointed at entries from an older zdns can detect and
+// discard them instead of failing a type assertion deep in GetCachedResult.
+const cacheWireVersion = 1
+
+func init() {
+	// CachedResult.Answers is keyed/valued by interface{}; gob needs concrete types registered up front
+	// to encode/decode the Answer values that actually flow through the cache.
+	gob.Register(Answer{})
+}
+
+// encodeCachedResult serializes a CachedResult for an out-of-process backend (Redis, memcached).
+func encodeCachedResult(r CachedResult) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(cacheWireVersion)
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, fmt.Errorf("encode cached result: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCachedResult deserializes a value previously produced by encodeCachedResult. A version mismatch
+// is treated the same as a cache miss by callers: the entry is simply not usable.
+func decodeCachedResult(data []byte) (CachedResult, error) {
+	var r CachedResult
+	if len(data) == 0 {
+		return r, fmt.Errorf("empty cached result")
+	}
+	if data[0] != cacheWireVersion {
+		return r, fmt.Errorf("unsupported cache wire version %d", data[0])
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&r); err != nil {
+		return r, fmt.Errorf("decode cached result: %w", err)
+	}
+	return r, nil
+}
+
+// cacheEntry pairs a CachedKey with its CachedResult. RedisCache stores entries encoded this way (rather
+// than just the CachedResult) so that Snapshot can recover the original CachedKey for each entry it finds
+// while scanning the keyspace - the Redis key itself is a hash-tagged string, not a serialized CachedKey.
+type cacheEntry struct {
+	Key    CachedKey
+	Result CachedResult
+}
+
+// encodeCacheEntry serializes key and result together for a backend (RedisCache) whose Snapshot needs to
+// recover the original CachedKey from a keyspace scan.
+func encodeCacheEntry(key CachedKey, result CachedResult) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(cacheWireVersion)
+	if err := gob.NewEncoder(&buf).Encode(cacheEntry{Key: key, Result: result}); err != nil {
+		return nil, fmt.Errorf("encode cache entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCacheEntry deserializes a value previously produced by encodeCacheEntry.
+func decodeCacheEntry(data []byte) (CachedKey, CachedResult, error) {
+	var e cacheEntry
+	if len(data) == 0 {
+		return CachedKey{}, CachedResult{}, fmt.Errorf("empty cache entry")
+	}
+	if data[0] != cacheWireVersion {
+		return CachedKey{}, CachedResult{}, fmt.Errorf("unsupported cache wire version %d", data[0])
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&e); err != nil {
+		return CachedKey{}, CachedResult{}, fmt.Errorf("decode cache entry: %w", err)
+	}
+	return e.Key, e.Result, nil
+}